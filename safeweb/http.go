@@ -0,0 +1,243 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package safeweb provides a wrapper around [http.ServeMux] that applies
+// security best practices (CSRF protection, Content-Security-Policy and
+// Referrer-Policy headers, request content-type validation, and CORS) to
+// handlers serving browser traffic, while leaving a separate mux free for
+// programmatic API clients that don't share a browser's ambient authority.
+package safeweb
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Config is the configuration for a [Server].
+type Config struct {
+	// BrowserMux is the mux used to serve requests that are expected to
+	// originate from a browser. Handlers registered to BrowserMux are
+	// protected by CSRF protection, Content-Security-Policy and
+	// Referrer-Policy headers, and content-type validation appropriate for
+	// browser form submissions.
+	BrowserMux *http.ServeMux
+
+	// APIMux is the mux used to serve requests that are expected to come
+	// from programmatic API clients rather than browsers. Handlers
+	// registered to APIMux are not protected by CSRF, CSP, or
+	// Referrer-Policy, since API clients don't carry a browser's ambient
+	// authority (cookies sent automatically, etc).
+	APIMux *http.ServeMux
+
+	// BrowserCORSPolicies is the list of CORS policies applied to BrowserMux
+	// requests, matched by the longest CORSPolicy.PathPrefix that contains
+	// the request path (as seen by BrowserMux, i.e. before any "/api"
+	// stripping). A path with no matching policy gets no CORS treatment at
+	// all: no headers are added, and preflight OPTIONS requests fall
+	// through to the underlying mux like any other request.
+	//
+	// BrowserCORSPolicies and APICORSPolicies are separate namespaces: a
+	// policy meant to scope a permissive, credentialed CORS grant to an
+	// APIMux route has no effect on a same-named BrowserMux path, and vice
+	// versa.
+	BrowserCORSPolicies []CORSPolicy
+
+	// APICORSPolicies is the list of CORS policies applied to APIMux
+	// requests, matched by the longest CORSPolicy.PathPrefix that contains
+	// the request path as seen by APIMux (i.e. after the "/api" prefix has
+	// been stripped). See BrowserCORSPolicies for how policies are matched
+	// and what an unmatched path gets.
+	APICORSPolicies []CORSPolicy
+
+	// SecureContext, if true, marks the CSRF cookie as Secure. It should be
+	// set for servers that are only ever reached over HTTPS.
+	SecureContext bool
+
+	// CSPAllowInlineStyles, if true, adds 'unsafe-inline' to the style-src
+	// directive of the Content-Security-Policy header emitted for
+	// BrowserMux routes.
+	CSPAllowInlineStyles bool
+
+	// CSPUseNonces, if true, generates a fresh cryptographically-random
+	// nonce for every BrowserMux request and adds it to the script-src (and,
+	// if combined with CSPAllowInlineStyles, style-src) directive of the
+	// Content-Security-Policy header as 'nonce-XXXX'. The nonce is
+	// available to handlers via [CSPNonce] and to html/template templates
+	// via the "cspNonce" FuncMap entry from [TemplateFuncs].
+	CSPUseNonces bool
+
+	// APIKeyValidator, if non-nil, is called on requests to BrowserMux routes
+	// that carry a non-empty APIKeyHeaderName header or APIKeyQueryParam
+	// query parameter, to determine whether that API key is valid. If
+	// it returns true, the request is exempted from CSRF token validation,
+	// the same way requests to APIMux are: this lets programmatic clients
+	// that hold a long-lived API key call BrowserMux routes directly,
+	// without needing a CSRF token dance. Content-type validation and the
+	// other security headers still apply.
+	APIKeyValidator func(*http.Request) bool
+
+	// APIKeyHeaderName is the header consulted, in addition to
+	// APIKeyQueryParam, when deciding whether a request carries an API key
+	// for the purposes of APIKeyValidator. It has no effect unless
+	// APIKeyValidator is also set. Defaults to "Authorization".
+	APIKeyHeaderName string
+
+	// APIKeyQueryParam is the query parameter consulted, in addition to
+	// APIKeyHeaderName, when deciding whether a request carries an API key
+	// for the purposes of APIKeyValidator. It has no effect unless
+	// APIKeyValidator is also set. Defaults to "api_key".
+	APIKeyQueryParam string
+
+	// CSRFExemptPaths is a list of path prefixes within BrowserMux that are
+	// exempt from CSRF token validation, e.g. path-based proxied apps or
+	// OIDC/SAML callback endpoints that arrive as cross-site POSTs carrying
+	// their own state token. The rest of BrowserMux remains protected.
+	CSRFExemptPaths []string
+
+	// CSRFExemptFunc, if non-nil, is called for requests to BrowserMux that
+	// reach CSRF validation and aren't already exempted by APIKeyValidator
+	// or CSRFExemptPaths; if it returns true, the request is exempted from
+	// CSRF token validation.
+	CSRFExemptFunc func(*http.Request) bool
+
+	// CSRFCookieName, CSRFHeaderName, and CSRFFieldName override the
+	// gorilla/csrf defaults ("_gorilla_csrf", "X-CSRF-Token", and
+	// "gorilla.csrf.Token" respectively) for the cookie, header, and form
+	// field used to carry the CSRF token, so downstreams can align with an
+	// existing frontend. Each defaults to the gorilla/csrf default when
+	// empty.
+	CSRFCookieName string
+	CSRFHeaderName string
+	CSRFFieldName  string
+
+	// CSRFErrorHandler, if non-nil, is called instead of the default plain
+	// 403 response when CSRF validation fails, with reason describing why
+	// (see gorilla/csrf's FailureReason). Use it for structured JSON error
+	// responses in XHR-heavy UIs.
+	CSRFErrorHandler func(w http.ResponseWriter, r *http.Request, reason error)
+
+	// Interceptors is an ordered list of additional interceptors run on
+	// every route, after the built-in content-type, CORS, CSP,
+	// Referrer-Policy, and CSRF interceptors and before the final handler.
+	// Use it for things like audit logging, rate limiting, or
+	// application-specific auth checks.
+	Interceptors []Interceptor
+}
+
+// CORSPolicy configures cross-origin resource sharing for requests whose
+// path falls under PathPrefix.
+type CORSPolicy struct {
+	// PathPrefix selects which requests this policy applies to. When more
+	// than one policy's PathPrefix matches a request, the longest prefix
+	// wins.
+	PathPrefix string
+
+	// AllowOrigins is the list of origins allowed to make cross-origin
+	// requests under PathPrefix. An entry may use a single "*" wildcard
+	// label to match any subdomain, e.g. "https://*.example.com". If
+	// AllowOrigins is non-empty, AllowMethods must also be set.
+	AllowOrigins []string
+
+	// AllowOriginFunc, if non-nil, is consulted in addition to AllowOrigins
+	// to decide whether an origin is permitted.
+	AllowOriginFunc func(origin string) bool
+
+	// AllowMethods is the list of HTTP methods permitted for cross-origin
+	// requests under PathPrefix. It is echoed as
+	// Access-Control-Allow-Methods, and also used to compute the Allow
+	// header, on preflight responses.
+	AllowMethods []string
+
+	// AllowHeaders is the list of request headers permitted for
+	// cross-origin requests under PathPrefix.
+	AllowHeaders []string
+
+	// ExposeHeaders is the list of response headers a browser is allowed to
+	// read from a cross-origin response.
+	ExposeHeaders []string
+
+	// AllowCredentials, if true, permits the request to carry credentials
+	// (cookies, HTTP auth) and sets Access-Control-Allow-Credentials: true.
+	AllowCredentials bool
+
+	// MaxAge, if positive, is how long browsers may cache a preflight
+	// response, sent as Access-Control-Max-Age in seconds.
+	MaxAge time.Duration
+}
+
+// Server is an HTTP server that wraps a BrowserMux and an APIMux with
+// security best practices.
+type Server struct {
+	h *http.Server
+}
+
+// NewServer creates a new [Server] from the given [Config].
+func NewServer(cfg Config) (*Server, error) {
+	for _, policies := range [][]CORSPolicy{cfg.BrowserCORSPolicies, cfg.APICORSPolicies} {
+		for _, p := range policies {
+			if (len(p.AllowOrigins) > 0 || p.AllowOriginFunc != nil) && len(p.AllowMethods) == 0 {
+				return nil, fmt.Errorf("safeweb: CORSPolicy for %q: AllowMethods must be set when AllowOrigins or AllowOriginFunc is set", p.PathPrefix)
+			}
+		}
+	}
+	if cfg.APIKeyHeaderName == "" {
+		cfg.APIKeyHeaderName = "Authorization"
+	}
+	if cfg.APIKeyQueryParam == "" {
+		cfg.APIKeyQueryParam = "api_key"
+	}
+
+	authKey := make([]byte, 32)
+	if _, err := rand.Read(authKey); err != nil {
+		return nil, fmt.Errorf("safeweb: generating CSRF auth key: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	switch {
+	case cfg.BrowserMux != nil && cfg.APIMux != nil:
+		mux.Handle("/", browserHandler(cfg, authKey))
+		mux.Handle("/api/", http.StripPrefix("/api", apiHandler(cfg)))
+	case cfg.BrowserMux != nil:
+		mux.Handle("/", browserHandler(cfg, authKey))
+	case cfg.APIMux != nil:
+		mux.Handle("/", apiHandler(cfg))
+	}
+
+	return &Server{h: &http.Server{Handler: mux}}, nil
+}
+
+// ListenAndServe listens on the given address and serves requests until the
+// process is killed or the server otherwise fails.
+func (s *Server) ListenAndServe(addr string) error {
+	s.h.Addr = addr
+	return s.h.ListenAndServe()
+}
+
+// browserHandler wraps cfg.BrowserMux with the built-in interceptors
+// (content-type validation, CORS, CSP, Referrer-Policy, CSRF) plus any
+// configured in cfg.Interceptors. CSP and Referrer-Policy run ahead of CSRF
+// so their headers still apply to a request CSRF validation rejects.
+func browserHandler(cfg Config, authKey []byte) http.Handler {
+	ics := []Interceptor{
+		contentTypeInterceptor{isAPI: false},
+		corsInterceptor{policies: cfg.BrowserCORSPolicies, mux: cfg.BrowserMux},
+		cspInterceptor{cfg: cfg},
+		referrerPolicyInterceptor{},
+		newCSRFInterceptor(cfg, authKey),
+	}
+	ics = append(ics, cfg.Interceptors...)
+	return chain(ics, cfg.BrowserMux)
+}
+
+// apiHandler wraps cfg.APIMux with the built-in CORS and content-type
+// interceptors plus any configured in cfg.Interceptors.
+func apiHandler(cfg Config) http.Handler {
+	ics := []Interceptor{
+		contentTypeInterceptor{isAPI: true},
+		corsInterceptor{policies: cfg.APICORSPolicies, mux: cfg.APIMux},
+	}
+	ics = append(ics, cfg.Interceptors...)
+	return chain(ics, cfg.APIMux)
+}
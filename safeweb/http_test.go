@@ -4,6 +4,7 @@
 package safeweb
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
@@ -14,17 +15,17 @@ import (
 )
 
 func TestCompleteCORSConfig(t *testing.T) {
-	_, err := NewServer(Config{AccessControlAllowOrigin: []string{"https://foobar.com"}})
+	_, err := NewServer(Config{APICORSPolicies: []CORSPolicy{{PathPrefix: "/", AllowOrigins: []string{"https://foobar.com"}}}})
 	if err == nil {
-		t.Fatalf("expected error when AccessControlAllowOrigin is provided without AccessControlAllowMethods")
+		t.Fatalf("expected error when AllowOrigins is provided without AllowMethods")
 	}
 
-	_, err = NewServer(Config{AccessControlAllowMethods: []string{"GET", "POST"}})
+	_, err = NewServer(Config{APICORSPolicies: []CORSPolicy{{PathPrefix: "/", AllowOriginFunc: func(string) bool { return true }}}})
 	if err == nil {
-		t.Fatalf("expected error when AccessControlAllowMethods is provided without AccessControlAllowOrigin")
+		t.Fatalf("expected error when AllowOriginFunc is provided without AllowMethods")
 	}
 
-	_, err = NewServer(Config{AccessControlAllowOrigin: []string{"https://foobar.com"}, AccessControlAllowMethods: []string{"GET", "POST"}})
+	_, err = NewServer(Config{APICORSPolicies: []CORSPolicy{{PathPrefix: "/", AllowOrigins: []string{"https://foobar.com"}, AllowMethods: []string{"GET", "POST"}}}})
 	if err != nil {
 		t.Fatalf("error creating server with complete CORS configuration: %v", err)
 	}
@@ -97,27 +98,50 @@ func TestAPIMuxCrossOriginResourceSharingHeaders(t *testing.T) {
 	tests := []struct {
 		name            string
 		httpMethod      string
+		preflight       bool
+		origin          string
 		wantCORSHeaders bool
 		corsOrigins     []string
 		corsMethods     []string
 	}{
 		{
-			name:            "do not set CORS headers for non-OPTIONS requests",
+			name:            "set CORS headers for matching origin on non-OPTIONS requests",
 			corsOrigins:     []string{"https://foobar.com"},
 			corsMethods:     []string{"GET", "POST", "HEAD"},
 			httpMethod:      "GET",
+			origin:          "https://foobar.com",
+			wantCORSHeaders: true,
+		},
+		{
+			name:            "do not set CORS headers for non-matching origin",
+			corsOrigins:     []string{"https://foobar.com"},
+			corsMethods:     []string{"GET", "POST", "HEAD"},
+			httpMethod:      "GET",
+			origin:          "https://evil.com",
 			wantCORSHeaders: false,
 		},
 		{
-			name:            "set CORS headers for non-OPTIONS requests",
+			name:            "set CORS headers for preflight requests",
 			corsOrigins:     []string{"https://foobar.com"},
 			corsMethods:     []string{"GET", "POST", "HEAD"},
 			httpMethod:      "OPTIONS",
+			origin:          "https://foobar.com",
+			preflight:       true,
 			wantCORSHeaders: true,
 		},
 		{
-			name:            "do not serve CORS headers for OPTIONS requests with no configured origins",
+			name:            "do not serve CORS headers for requests with no Origin header",
+			corsOrigins:     []string{"https://foobar.com"},
+			corsMethods:     []string{"GET", "POST", "HEAD"},
+			httpMethod:      "OPTIONS",
+			preflight:       true,
+			wantCORSHeaders: false,
+		},
+		{
+			name:            "do not serve CORS headers for paths with no configured policy",
 			httpMethod:      "OPTIONS",
+			origin:          "https://foobar.com",
+			preflight:       true,
 			wantCORSHeaders: false,
 		},
 	}
@@ -128,16 +152,22 @@ func TestAPIMuxCrossOriginResourceSharingHeaders(t *testing.T) {
 			h.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				w.Write([]byte("ok"))
 			}))
-			s, err := NewServer(Config{
-				APIMux:                    h,
-				AccessControlAllowOrigin:  tt.corsOrigins,
-				AccessControlAllowMethods: tt.corsMethods,
-			})
+			var policies []CORSPolicy
+			if len(tt.corsOrigins) > 0 {
+				policies = []CORSPolicy{{PathPrefix: "/", AllowOrigins: tt.corsOrigins, AllowMethods: tt.corsMethods}}
+			}
+			s, err := NewServer(Config{APIMux: h, APICORSPolicies: policies})
 			if err != nil {
 				t.Fatal(err)
 			}
 
 			req := httptest.NewRequest(tt.httpMethod, "/", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", "GET")
+			}
 			w := httptest.NewRecorder()
 			s.h.Handler.ServeHTTP(w, req)
 			resp := w.Result()
@@ -149,6 +179,92 @@ func TestAPIMuxCrossOriginResourceSharingHeaders(t *testing.T) {
 	}
 }
 
+func TestCORSWildcardSubdomain(t *testing.T) {
+	h := &http.ServeMux{}
+	h.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	s, err := NewServer(Config{
+		APIMux: h,
+		APICORSPolicies: []CORSPolicy{
+			{PathPrefix: "/", AllowOrigins: []string{"https://*.example.com"}, AllowMethods: []string{"GET"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "https://sub.example.com")
+	w := httptest.NewRecorder()
+	s.h.Handler.ServeHTTP(w, req)
+	resp := w.Result()
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://sub.example.com" {
+		t.Fatalf("access-control-allow-origin want: %q; got: %q", "https://sub.example.com", got)
+	}
+}
+
+func TestCORSPreflightRejectsDisallowedOrigin(t *testing.T) {
+	h := &http.ServeMux{}
+	h.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	s, err := NewServer(Config{
+		APIMux: h,
+		APICORSPolicies: []CORSPolicy{
+			{PathPrefix: "/", AllowOrigins: []string{"https://foobar.com"}, AllowMethods: []string{"GET"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("OPTIONS", "/", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	w := httptest.NewRecorder()
+	s.h.Handler.ServeHTTP(w, req)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("preflight from disallowed origin want: %v; got: %v", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestCORSPoliciesDoNotCrossMuxes(t *testing.T) {
+	browserMux := &http.ServeMux{}
+	browserMux.Handle("/widgets", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	apiMux := &http.ServeMux{}
+	apiMux.Handle("/widgets", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	s, err := NewServer(Config{
+		BrowserMux: browserMux,
+		APIMux:     apiMux,
+		APICORSPolicies: []CORSPolicy{
+			{PathPrefix: "/widgets", AllowOrigins: []string{"https://evil.example"}, AllowMethods: []string{"GET"}, AllowCredentials: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/widgets", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	w := httptest.NewRecorder()
+	s.h.Handler.ServeHTTP(w, req)
+	resp := w.Result()
+
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Fatalf("a CORS policy scoped to APICORSPolicies leaked into BrowserMux: Access-Control-Allow-Origin = %q", got)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Fatalf("a CORS policy scoped to APICORSPolicies leaked into BrowserMux: Access-Control-Allow-Credentials = %q", got)
+	}
+}
+
 func TestCSRFProtection(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -232,6 +348,249 @@ func TestCSRFProtection(t *testing.T) {
 	}
 }
 
+func TestCSRFAPIKeyBypass(t *testing.T) {
+	tests := []struct {
+		name       string
+		validator  func(*http.Request) bool
+		apiKey     string
+		wantStatus int
+	}{
+		{
+			name:       "request with valid API key bypasses CSRF check",
+			validator:  func(r *http.Request) bool { return r.Header.Get("Authorization") == "valid" },
+			apiKey:     "valid",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "request with invalid API key still requires CSRF token",
+			validator:  func(r *http.Request) bool { return r.Header.Get("Authorization") == "valid" },
+			apiKey:     "invalid",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "request with no API key still requires CSRF token",
+			validator:  func(r *http.Request) bool { return r.Header.Get("Authorization") == "valid" },
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &http.ServeMux{}
+			h.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			}))
+			s, err := NewServer(Config{BrowserMux: h, APIKeyValidator: tt.validator})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("POST", "/", nil)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.apiKey != "" {
+				req.Header.Set("Authorization", tt.apiKey)
+			}
+
+			w := httptest.NewRecorder()
+			s.h.Handler.ServeHTTP(w, req)
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("api key bypass check failed: got %v; want %v", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCSRFExemptPaths(t *testing.T) {
+	tests := []struct {
+		name        string
+		exemptPaths []string
+		exemptFunc  func(*http.Request) bool
+		requestPath string
+		contentType string
+		wantStatus  int
+	}{
+		{
+			name:        "request under exempt prefix skips CSRF check",
+			exemptPaths: []string{"/callback/"},
+			requestPath: "/callback/oidc",
+			contentType: "application/x-www-form-urlencoded",
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "request outside exempt prefix still requires CSRF token",
+			exemptPaths: []string{"/callback/"},
+			requestPath: "/other",
+			contentType: "application/x-www-form-urlencoded",
+			wantStatus:  http.StatusForbidden,
+		},
+		{
+			name:        "request matching exempt predicate skips CSRF check",
+			exemptFunc:  func(r *http.Request) bool { return r.URL.Path == "/webhook" },
+			requestPath: "/webhook",
+			contentType: "application/x-www-form-urlencoded",
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "exemption does not bypass content-type validation",
+			exemptPaths: []string{"/callback/"},
+			requestPath: "/callback/oidc",
+			contentType: "text/plain",
+			wantStatus:  http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &http.ServeMux{}
+			h.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			}))
+			s, err := NewServer(Config{BrowserMux: h, CSRFExemptPaths: tt.exemptPaths, CSRFExemptFunc: tt.exemptFunc})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("POST", tt.requestPath, nil)
+			req.Header.Set("Content-Type", tt.contentType)
+
+			w := httptest.NewRecorder()
+			s.h.Handler.ServeHTTP(w, req)
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("csrf exemption check failed: got %v; want %v", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+type recordingInterceptor struct {
+	name         string
+	order        *[]string
+	shortCircuit int
+}
+
+func (r recordingInterceptor) Before(w http.ResponseWriter, req *http.Request) (*http.Request, Result) {
+	*r.order = append(*r.order, r.name+":before")
+	if r.shortCircuit != 0 {
+		return req, Result{StatusCode: r.shortCircuit}
+	}
+	return req, Result{}
+}
+
+func (r recordingInterceptor) Commit(w http.ResponseWriter, req *http.Request) {
+	*r.order = append(*r.order, r.name+":commit")
+}
+
+func TestInterceptorOrdering(t *testing.T) {
+	var order []string
+	h := &http.ServeMux{}
+	h.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+		w.Write([]byte("ok"))
+	}))
+
+	s, err := NewServer(Config{
+		APIMux: h,
+		Interceptors: []Interceptor{
+			recordingInterceptor{name: "a", order: &order},
+			recordingInterceptor{name: "b", order: &order},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	s.h.Handler.ServeHTTP(w, req)
+
+	want := []string{"a:before", "b:before", "a:commit", "b:commit", "handler"}
+	if len(order) != len(want) {
+		t.Fatalf("interceptor order = %v; want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("interceptor order = %v; want %v", order, want)
+		}
+	}
+}
+
+func TestInterceptorShortCircuit(t *testing.T) {
+	var order []string
+	h := &http.ServeMux{}
+	h.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+		w.Write([]byte("ok"))
+	}))
+
+	s, err := NewServer(Config{
+		APIMux: h,
+		Interceptors: []Interceptor{
+			recordingInterceptor{name: "a", order: &order, shortCircuit: http.StatusTeapot},
+			recordingInterceptor{name: "b", order: &order},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	s.h.Handler.ServeHTTP(w, req)
+	resp := w.Result()
+
+	if resp.StatusCode != http.StatusTeapot {
+		t.Fatalf("status = %v; want %v", resp.StatusCode, http.StatusTeapot)
+	}
+	want := []string{"a:before"}
+	if len(order) != len(want) || order[0] != want[0] {
+		t.Fatalf("interceptor order = %v; want short-circuit after a:before, i.e. %v", order, want)
+	}
+}
+
+func TestCustomInterceptorSeesRequestAfterCSRF(t *testing.T) {
+	h := &http.ServeMux{}
+	h.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	var order []string
+	s, err := NewServer(Config{
+		BrowserMux: h,
+		Interceptors: []Interceptor{
+			recordingInterceptor{name: "custom", order: &order},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A GET request doesn't require a CSRF token, so it should reach the
+	// custom interceptor and the handler.
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	s.h.Handler.ServeHTTP(w, req)
+
+	if len(order) == 0 || order[0] != "custom:before" {
+		t.Fatalf("expected custom interceptor to run, got order %v", order)
+	}
+
+	// A POST without a CSRF token should never reach the custom
+	// interceptor: CSRF validation runs ahead of it in the chain.
+	order = nil
+	req = httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	s.h.Handler.ServeHTTP(w, req)
+	resp := w.Result()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %v; want %v", resp.StatusCode, http.StatusForbidden)
+	}
+	if len(order) != 0 {
+		t.Fatalf("expected custom interceptor not to run on CSRF failure, got order %v", order)
+	}
+}
+
 func TestContentSecurityPolicyHeader(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -279,6 +638,139 @@ func TestContentSecurityPolicyHeader(t *testing.T) {
 	}
 }
 
+func TestCSRFFieldRoundTrip(t *testing.T) {
+	h := &http.ServeMux{}
+	h.Handle("/form", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(CSRFField(r)))
+	}))
+	s, err := NewServer(Config{BrowserMux: h})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := httptest.NewRequest("GET", "/form", nil)
+	w := httptest.NewRecorder()
+	s.h.Handler.ServeHTTP(w, get)
+	resp := w.Result()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `name="gorilla.csrf.Token"`) {
+		t.Fatalf("CSRFField output %q did not contain the expected hidden input", body)
+	}
+
+	// extract the token value and round-trip it through a POST.
+	const marker = `value="`
+	start := strings.Index(string(body), marker) + len(marker)
+	end := strings.Index(string(body)[start:], `"`)
+	token := string(body)[start : start+end]
+
+	post := httptest.NewRequest("POST", "/form", nil)
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	post.Header.Set("X-CSRF-Token", token)
+	for _, c := range resp.Cookies() {
+		post.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	s.h.Handler.ServeHTTP(w, post)
+	if got := w.Result().StatusCode; got != http.StatusOK {
+		t.Fatalf("POST with round-tripped CSRF token got status %v; want %v", got, http.StatusOK)
+	}
+}
+
+func TestCSRFCustomErrorHandler(t *testing.T) {
+	h := &http.ServeMux{}
+	h.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	var gotReason error
+	s, err := NewServer(Config{
+		BrowserMux: h,
+		CSRFErrorHandler: func(w http.ResponseWriter, r *http.Request, reason error) {
+			gotReason = reason
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":"csrf"}`))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.h.Handler.ServeHTTP(w, req)
+	resp := w.Result()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %v; want %v", resp.StatusCode, http.StatusForbidden)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Content-Type = %q; want application/json", resp.Header.Get("Content-Type"))
+	}
+	if gotReason == nil {
+		t.Fatalf("expected CSRFErrorHandler to receive a non-nil reason")
+	}
+}
+
+func TestCSPNonces(t *testing.T) {
+	var seenNonces []string
+	h := &http.ServeMux{}
+	h.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenNonces = append(seenNonces, CSPNonce(r))
+		w.Write([]byte("ok"))
+	}))
+	s, err := NewServer(Config{BrowserMux: h, CSPUseNonces: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var headerNonces []string
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		s.h.Handler.ServeHTTP(w, req)
+		resp := w.Result()
+
+		csp := resp.Header.Get("Content-Security-Policy")
+		if !strings.Contains(csp, "script-src 'self' 'nonce-"+seenNonces[i]+"'") {
+			t.Fatalf("CSP header %q does not agree with context nonce %q", csp, seenNonces[i])
+		}
+		headerNonces = append(headerNonces, seenNonces[i])
+	}
+
+	if headerNonces[0] == headerNonces[1] {
+		t.Fatalf("expected distinct nonces per request, got %q both times", headerNonces[0])
+	}
+}
+
+func TestCSPNoncesNotEmittedOnAPIMux(t *testing.T) {
+	h := &http.ServeMux{}
+	h.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := CSPNonce(r); n != "" {
+			t.Errorf("expected no CSP nonce on APIMux route, got %q", n)
+		}
+		w.Write([]byte("ok"))
+	}))
+	s, err := NewServer(Config{APIMux: h, CSPUseNonces: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	s.h.Handler.ServeHTTP(w, req)
+	resp := w.Result()
+
+	if resp.Header.Get("Content-Security-Policy") != "" {
+		t.Fatalf("expected no Content-Security-Policy header on APIMux route, got %q", resp.Header.Get("Content-Security-Policy"))
+	}
+}
+
 func TestCSRFCookieSecureMode(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -320,21 +812,21 @@ func TestCSRFCookieSecureMode(t *testing.T) {
 	}
 }
 
-func TestRefererPolicy(t *testing.T) {
+func TestReferrerPolicy(t *testing.T) {
 	tests := []struct {
-		name              string
-		browserRoute      bool
-		wantRefererPolicy bool
+		name               string
+		browserRoute       bool
+		wantReferrerPolicy bool
 	}{
 		{
-			name:              "BrowserMux routes get Referer-Policy headers",
-			browserRoute:      true,
-			wantRefererPolicy: true,
+			name:               "BrowserMux routes get Referrer-Policy headers",
+			browserRoute:       true,
+			wantReferrerPolicy: true,
 		},
 		{
-			name:              "APIMux routes do not get Referer-Policy headers",
-			browserRoute:      false,
-			wantRefererPolicy: false,
+			name:               "APIMux routes do not get Referrer-Policy headers",
+			browserRoute:       false,
+			wantReferrerPolicy: false,
 		},
 	}
 
@@ -360,8 +852,8 @@ func TestRefererPolicy(t *testing.T) {
 			s.h.Handler.ServeHTTP(w, req)
 			resp := w.Result()
 
-			if (resp.Header.Get("Referer-Policy") == "") == tt.wantRefererPolicy {
-				t.Fatalf("referer policy want: %v; got: %v", tt.wantRefererPolicy, resp.Header.Get("Referer-Policy"))
+			if (resp.Header.Get("Referrer-Policy") == "") == tt.wantReferrerPolicy {
+				t.Fatalf("referrer policy want: %v; got: %v", tt.wantReferrerPolicy, resp.Header.Get("Referrer-Policy"))
 			}
 		})
 	}
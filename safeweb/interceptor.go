@@ -0,0 +1,454 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package safeweb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/csrf"
+)
+
+// Result is returned by [Interceptor.Before] to control whether the
+// interceptor chain continues.
+type Result struct {
+	// StatusCode, if non-zero, stops the chain: no further interceptors or
+	// the final handler run. If the interceptor hasn't already written a
+	// response itself (as gorilla/csrf does on failure), StatusCode is
+	// written as the response status.
+	StatusCode int
+}
+
+// Interceptor is a pluggable unit of request-handling behavior (CSRF
+// protection, CSP headers, CORS, audit logging, rate limiting, and so on)
+// that a [Server] runs around every request to a mux.
+//
+// Before runs for every interceptor, in order, before the final handler.
+// Returning a non-zero Result.StatusCode short-circuits the request; it may
+// also return a modified request (for example, one carrying an additional
+// context value) that subsequent interceptors and the final handler see.
+//
+// Commit runs for every interceptor that wasn't short-circuited, in order,
+// immediately before the final handler is invoked. It exists for work that
+// needs to happen after every Before has run but before any response body
+// is written, such as stamping a cookie or finalizing a header that depends
+// on what other interceptors decided. Because Commit is skipped once any
+// interceptor short-circuits, work that must apply to a rejected request
+// too (e.g. security headers) should happen in Before instead.
+type Interceptor interface {
+	Before(w http.ResponseWriter, r *http.Request) (*http.Request, Result)
+	Commit(w http.ResponseWriter, r *http.Request)
+}
+
+// chain runs interceptors' Before phases in order, then (if none
+// short-circuited) their Commit phases in order, then finally h. Because
+// Commit doesn't run once an interceptor short-circuits, interceptors that
+// must apply to a rejected request too (e.g. security headers that should be
+// present on an error response) need to act in Before instead: see
+// cspInterceptor and referrerPolicyInterceptor, and their ordering ahead of
+// csrfInterceptor in browserHandler.
+func chain(interceptors []Interceptor, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &committedWriter{ResponseWriter: w}
+		for _, ic := range interceptors {
+			var res Result
+			r, res = ic.Before(cw, r)
+			if cw.committed {
+				// The interceptor already wrote its own response (e.g. a
+				// CSRF failure page).
+				return
+			}
+			if res.StatusCode != 0 {
+				cw.WriteHeader(res.StatusCode)
+				return
+			}
+		}
+		for _, ic := range interceptors {
+			ic.Commit(cw, r)
+		}
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// committedWriter tracks whether a response has started being written, so
+// the chain driver can tell an interceptor that already wrote a response
+// apart from one that merely returned a short-circuiting Result.
+type committedWriter struct {
+	http.ResponseWriter
+	committed bool
+}
+
+func (w *committedWriter) WriteHeader(code int) {
+	w.committed = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *committedWriter) Write(b []byte) (int, error) {
+	w.committed = true
+	return w.ResponseWriter.Write(b)
+}
+
+// contentTypeInterceptor rejects POST/PUT/PATCH requests whose Content-Type
+// isn't appropriate for the kind of route being served: JSON only for API
+// routes, and JSON or form submissions for browser routes.
+type contentTypeInterceptor struct {
+	isAPI bool
+}
+
+func (c contentTypeInterceptor) Before(w http.ResponseWriter, r *http.Request) (*http.Request, Result) {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return r, Result{}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !validContentType(c.isAPI, mediaType) {
+		http.Error(w, "invalid content-type", http.StatusBadRequest)
+		return r, Result{StatusCode: http.StatusBadRequest}
+	}
+	return r, Result{}
+}
+
+func (contentTypeInterceptor) Commit(http.ResponseWriter, *http.Request) {}
+
+func validContentType(isAPI bool, mediaType string) bool {
+	if isAPI {
+		return mediaType == "application/json"
+	}
+	switch mediaType {
+	case "application/json", "application/x-www-form-urlencoded", "multipart/form-data":
+		return true
+	}
+	return false
+}
+
+// cspNonceContextKey is the context key under which the per-request CSP
+// nonce is stashed by cspInterceptor when Config.CSPUseNonces is set.
+type cspNonceContextKey struct{}
+
+// cspInterceptor sets a Content-Security-Policy header in Before, so that it
+// applies even to a request a later interceptor (e.g. csrfInterceptor)
+// rejects. When CSPUseNonces is set, Before also generates a fresh
+// per-request nonce and stashes it in the request's context so the header
+// set below, the final handler, and CSPNonce all agree on its value.
+type cspInterceptor struct {
+	cfg Config
+}
+
+func (c cspInterceptor) Before(w http.ResponseWriter, r *http.Request) (*http.Request, Result) {
+	var nonce string
+	if c.cfg.CSPUseNonces {
+		var err error
+		nonce, err = newCSPNonce()
+		if err != nil {
+			http.Error(w, "failed to generate CSP nonce", http.StatusInternalServerError)
+			return r, Result{StatusCode: http.StatusInternalServerError}
+		}
+		ctx := context.WithValue(r.Context(), cspNonceContextKey{}, nonce)
+		r = r.WithContext(ctx)
+	}
+
+	scriptSrc := "script-src 'self'"
+	styleSrc := "style-src 'self'"
+	if c.cfg.CSPAllowInlineStyles {
+		styleSrc = "style-src 'self' 'unsafe-inline'"
+	}
+	if nonce != "" {
+		scriptSrc = fmt.Sprintf("script-src 'self' 'nonce-%s'", nonce)
+		if c.cfg.CSPAllowInlineStyles {
+			styleSrc = fmt.Sprintf("%s 'nonce-%s'", styleSrc, nonce)
+		}
+	}
+	csp := fmt.Sprintf("default-src 'self'; %s; %s; object-src 'none'; base-uri 'self'", scriptSrc, styleSrc)
+	w.Header().Set("Content-Security-Policy", csp)
+	return r, Result{}
+}
+
+func (cspInterceptor) Commit(http.ResponseWriter, *http.Request) {}
+
+// newCSPNonce returns a fresh, cryptographically random, base64-encoded CSP
+// nonce.
+func newCSPNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// CSPNonce returns the per-request Content-Security-Policy nonce generated
+// for r when its Server was configured with Config.CSPUseNonces, or the
+// empty string if none was generated (including for APIMux routes, which
+// never receive CSP headers or nonces).
+func CSPNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceContextKey{}).(string)
+	return nonce
+}
+
+// TemplateFuncs returns an html/template.FuncMap exposing a "cspNonce"
+// helper for BrowserMux templates, so handlers can render inline scripts as
+// <script nonce="{{cspNonce}}">...</script> without importing safeweb's
+// context plumbing directly.
+func TemplateFuncs(r *http.Request) template.FuncMap {
+	return template.FuncMap{
+		"cspNonce": func() string { return CSPNonce(r) },
+	}
+}
+
+// referrerPolicyInterceptor sets a Referrer-Policy header on every response,
+// in Before, so that it applies even to a request a later interceptor (e.g.
+// csrfInterceptor) rejects.
+type referrerPolicyInterceptor struct{}
+
+func (referrerPolicyInterceptor) Before(w http.ResponseWriter, r *http.Request) (*http.Request, Result) {
+	w.Header().Set("Referrer-Policy", "same-origin")
+	return r, Result{}
+}
+
+func (referrerPolicyInterceptor) Commit(http.ResponseWriter, *http.Request) {}
+
+// corsInterceptor implements CORS preflight handling and response headers
+// per the CORSPolicy matching the request path. A corsInterceptor is scoped
+// to a single mux (BrowserMux or APIMux): policies and path matching never
+// cross between the two, even when they register identically-named paths.
+type corsInterceptor struct {
+	policies []CORSPolicy
+	mux      *http.ServeMux
+}
+
+func (c corsInterceptor) Before(w http.ResponseWriter, r *http.Request) (*http.Request, Result) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return r, Result{}
+	}
+	policy, ok := matchCORSPolicy(c.policies, r.URL.Path)
+	if !ok {
+		return r, Result{}
+	}
+	allowed := originAllowed(policy, origin)
+
+	// A CORS preflight request is an OPTIONS request carrying
+	// Access-Control-Request-Method; plain OPTIONS requests fall through to
+	// the handler like any other method.
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		if !allowed {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return r, Result{StatusCode: http.StatusForbidden}
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		if registered := registeredMethods(c.mux, r.URL.Path, policy.AllowMethods); len(registered) > 0 {
+			w.Header().Set("Allow", strings.Join(registered, ", "))
+		}
+		if len(policy.AllowMethods) > 0 {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.AllowMethods, ", "))
+		}
+		if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+			if allowed := allowedCORSHeaders(policy, reqHeaders); allowed != "" {
+				w.Header().Set("Access-Control-Allow-Headers", allowed)
+			}
+		}
+		if policy.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if policy.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+		}
+		return r, Result{StatusCode: http.StatusNoContent}
+	}
+
+	if allowed {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		if policy.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if len(policy.ExposeHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposeHeaders, ", "))
+		}
+	}
+	return r, Result{}
+}
+
+func (corsInterceptor) Commit(http.ResponseWriter, *http.Request) {}
+
+// csrfInterceptor wraps gorilla/csrf protection, exempting any request that
+// csrfExempt identifies as carrying a valid API key, matching
+// CSRFExemptPaths, or satisfying CSRFExemptFunc.
+type csrfInterceptor struct {
+	cfg     Config
+	protect func(http.Handler) http.Handler
+}
+
+func newCSRFInterceptor(cfg Config, authKey []byte) csrfInterceptor {
+	opts := []csrf.Option{csrf.Secure(cfg.SecureContext)}
+	if cfg.CSRFCookieName != "" {
+		opts = append(opts, csrf.CookieName(cfg.CSRFCookieName))
+	}
+	if cfg.CSRFHeaderName != "" {
+		opts = append(opts, csrf.RequestHeader(cfg.CSRFHeaderName))
+	}
+	if cfg.CSRFFieldName != "" {
+		opts = append(opts, csrf.FieldName(cfg.CSRFFieldName))
+	}
+	if cfg.CSRFErrorHandler != nil {
+		opts = append(opts, csrf.ErrorHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg.CSRFErrorHandler(w, r, csrf.FailureReason(r))
+		})))
+	}
+	return csrfInterceptor{
+		cfg:     cfg,
+		protect: csrf.Protect(authKey, opts...),
+	}
+}
+
+// CSRFToken returns the CSRF token gorilla/csrf generated for r, for
+// handlers that need to embed it somewhere other than a standard form field
+// (e.g. a custom header or a JSON response).
+func CSRFToken(r *http.Request) string {
+	return csrf.Token(r)
+}
+
+// CSRFField returns a hidden <input> field carrying r's CSRF token, for
+// embedding directly in server-rendered forms without importing
+// gorilla/csrf, e.g. {{.CSRFField}} in an html/template.
+func CSRFField(r *http.Request) template.HTML {
+	return csrf.TemplateField(r)
+}
+
+func (c csrfInterceptor) Before(w http.ResponseWriter, r *http.Request) (*http.Request, Result) {
+	if !c.cfg.SecureContext {
+		// gorilla/csrf's Referer/Origin check assumes HTTPS, where a
+		// mismatched or missing Referer can only mean a cross-site request.
+		// Over plaintext HTTP that assumption doesn't hold (a stripped or
+		// absent Referer is routine), so tell it not to enforce the check.
+		// r.TLS is nil whenever TLS is terminated upstream of this process
+		// (the common deployment shape SecureContext itself describes), so
+		// it isn't a reliable plaintext signal and must not be consulted
+		// here.
+		r = csrf.PlaintextHTTPRequest(r)
+	}
+	if csrfExempt(c.cfg, r) {
+		r = csrf.UnsafeSkipCheck(r)
+	}
+	var next *http.Request
+	reached := false
+	c.protect(http.HandlerFunc(func(_ http.ResponseWriter, r2 *http.Request) {
+		reached = true
+		next = r2
+	})).ServeHTTP(w, r)
+	if !reached {
+		// gorilla/csrf already responded on w: a plain 403, or whatever
+		// Config.CSRFErrorHandler wrote.
+		return r, Result{StatusCode: http.StatusForbidden}
+	}
+	return next, Result{}
+}
+
+func (csrfInterceptor) Commit(http.ResponseWriter, *http.Request) {}
+
+// csrfExempt reports whether r should skip CSRF token validation, either
+// because it carries a valid API key, matches a CSRFExemptPaths prefix, or
+// satisfies CSRFExemptFunc.
+func csrfExempt(cfg Config, r *http.Request) bool {
+	if cfg.APIKeyValidator != nil && hasAPIKey(cfg, r) && cfg.APIKeyValidator(r) {
+		return true
+	}
+	for _, prefix := range cfg.CSRFExemptPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	if cfg.CSRFExemptFunc != nil && cfg.CSRFExemptFunc(r) {
+		return true
+	}
+	return false
+}
+
+// hasAPIKey reports whether r carries a candidate API key in the header or
+// query parameter configured on cfg.
+func hasAPIKey(cfg Config, r *http.Request) bool {
+	if r.Header.Get(cfg.APIKeyHeaderName) != "" {
+		return true
+	}
+	return r.URL.Query().Get(cfg.APIKeyQueryParam) != ""
+}
+
+// registeredMethods returns the subset of candidates that mux actually
+// routes reqPath to, by consulting mux.Handler, which reports a registered
+// path whose method doesn't match as an unmatched pattern. It reports
+// candidates unfiltered if mux is nil.
+func registeredMethods(mux *http.ServeMux, reqPath string, candidates []string) []string {
+	if mux == nil {
+		return candidates
+	}
+	var methods []string
+	for _, m := range candidates {
+		req, err := http.NewRequest(m, reqPath, nil)
+		if err != nil {
+			continue
+		}
+		if _, pattern := mux.Handler(req); pattern != "" {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+// matchCORSPolicy returns the policy with the longest PathPrefix containing
+// reqPath, if any.
+func matchCORSPolicy(policies []CORSPolicy, reqPath string) (CORSPolicy, bool) {
+	var best CORSPolicy
+	found := false
+	for _, p := range policies {
+		if strings.HasPrefix(reqPath, p.PathPrefix) && (!found || len(p.PathPrefix) > len(best.PathPrefix)) {
+			best = p
+			found = true
+		}
+	}
+	return best, found
+}
+
+// originAllowed reports whether origin is permitted by policy, via an exact
+// or wildcard match against AllowOrigins or via AllowOriginFunc.
+func originAllowed(policy CORSPolicy, origin string) bool {
+	for _, pattern := range policy.AllowOrigins {
+		if !strings.Contains(pattern, "*") {
+			if pattern == origin {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, origin); ok {
+			return true
+		}
+	}
+	return policy.AllowOriginFunc != nil && policy.AllowOriginFunc(origin)
+}
+
+// allowedCORSHeaders returns the subset of the comma-separated requested
+// headers that policy.AllowHeaders permits, joined for use in an
+// Access-Control-Allow-Headers response header.
+func allowedCORSHeaders(policy CORSPolicy, requested string) string {
+	var allowed []string
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		for _, a := range policy.AllowHeaders {
+			if strings.EqualFold(h, a) {
+				allowed = append(allowed, h)
+				break
+			}
+		}
+	}
+	return strings.Join(allowed, ", ")
+}